@@ -0,0 +1,205 @@
+// This file is part of testmynet_cli (http://github.com/marcopaganini/testmynet_cli)
+// See instructions in the README.md file that accompanies this program.
+// (C) by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// job describes a single test run against one server/location pair.
+type job struct {
+	location string
+	server   string
+}
+
+// jobResult holds the outcome of a single job: one result per mode
+// (download and/or upload) or an error if the job failed.
+type jobResult struct {
+	location string
+	server   string
+	results  []result
+	err      error
+}
+
+// runJob performs the download and/or upload tests (depending on opt.mode)
+// against a single server and returns the outcome as a jobResult. Each leg
+// (download, upload) is independent: a failing leg doesn't discard a
+// result already obtained from the other one, it just doesn't contribute a
+// result of its own.
+func runJob(opt *cmdLineOpts, j job) jobResult {
+	jr := jobResult{location: j.location, server: j.server}
+
+	if opt.mode == modeDownload || opt.mode == modeBoth {
+		bytes, duration, err := withRetry(opt.retries, func() (int64, time.Duration, error) {
+			return download(j.server, opt.datasize, opt.dryrun)
+		})
+		if err != nil {
+			jr.err = fmt.Errorf("download: %v", err)
+		} else {
+			jr.results = append(jr.results, newResult("download", bytes, duration))
+		}
+	}
+	if opt.mode == modeUpload || opt.mode == modeBoth {
+		bytes, duration, err := withRetry(opt.retries, func() (int64, time.Duration, error) {
+			return upload(j.server, opt.datasize, opt.dryrun)
+		})
+		if err != nil {
+			if jr.err != nil {
+				jr.err = fmt.Errorf("%v; upload: %v", jr.err, err)
+			} else {
+				jr.err = fmt.Errorf("upload: %v", err)
+			}
+		} else {
+			jr.results = append(jr.results, newResult("upload", bytes, duration))
+		}
+	}
+	return jr
+}
+
+// runBenchmark runs opt.repeat tests against every location/server pair in
+// opt.locations/opt.servers, using a fixed pool of opt.concurrency worker
+// goroutines. It returns one jobResult per test run, in no particular
+// order.
+func runBenchmark(opt *cmdLineOpts) []jobResult {
+	jobs := make(chan job)
+	resultsCh := make(chan jobResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < opt.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				resultsCh <- runJob(opt, j)
+			}
+		}()
+	}
+
+	go func() {
+		for ix, loc := range opt.locations {
+			for n := 0; n < opt.repeat; n++ {
+				jobs <- job{location: loc, server: opt.servers[ix]}
+			}
+		}
+		close(jobs)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(resultsCh)
+	}()
+
+	var all []jobResult
+	for jr := range resultsCh {
+		all = append(all, jr)
+	}
+	return all
+}
+
+// locStats holds summary statistics (in Mbps) for a given location/mode
+// combination, aggregated over every repeat run.
+type locStats struct {
+	location string
+	label    string
+	n        int
+	min      float64
+	median   float64
+	mean     float64
+	max      float64
+	stddev   float64
+}
+
+// aggregateStats groups the Mbps achieved by every successful result by
+// location and test mode (download/upload), and computes min/median/mean/
+// max/stddev for each group. A jobResult with a non-nil err can still
+// contribute the results of its other, successful leg.
+func aggregateStats(all []jobResult) []locStats {
+	type key struct {
+		location, label string
+	}
+	order := []key{}
+	groups := map[key][]float64{}
+
+	for _, jr := range all {
+		for _, r := range jr.results {
+			k := key{location: jr.location, label: r.label}
+			if _, ok := groups[k]; !ok {
+				order = append(order, k)
+			}
+			groups[k] = append(groups[k], r.bw)
+		}
+	}
+
+	stats := make([]locStats, 0, len(order))
+	for _, k := range order {
+		vals := groups[k]
+		stats = append(stats, locStats{
+			location: k.location,
+			label:    k.label,
+			n:        len(vals),
+			min:      minFloat64(vals),
+			median:   medianFloat64(vals),
+			mean:     meanFloat64(vals),
+			max:      maxFloat64(vals),
+			stddev:   stddevFloat64(vals),
+		})
+	}
+	return stats
+}
+
+func minFloat64(vals []float64) float64 {
+	m := vals[0]
+	for _, v := range vals[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+func maxFloat64(vals []float64) float64 {
+	m := vals[0]
+	for _, v := range vals[1:] {
+		if v > m {
+			m = v
+		}
+	}
+	return m
+}
+
+func meanFloat64(vals []float64) float64 {
+	sum := 0.0
+	for _, v := range vals {
+		sum += v
+	}
+	return sum / float64(len(vals))
+}
+
+func medianFloat64(vals []float64) float64 {
+	sorted := append([]float64{}, vals...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+func stddevFloat64(vals []float64) float64 {
+	if len(vals) < 2 {
+		return 0
+	}
+	mean := meanFloat64(vals)
+	sum := 0.0
+	for _, v := range vals {
+		d := v - mean
+		sum += d * d
+	}
+	return math.Sqrt(sum / float64(len(vals)))
+}
@@ -0,0 +1,67 @@
+// This file is part of testmynet_cli (http://github.com/marcopaganini/testmynet_cli)
+// See instructions in the README.md file that accompanies this program.
+// (C) by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestStddevFloat64(t *testing.T) {
+	tests := []struct {
+		name string
+		vals []float64
+		want float64
+	}{
+		{"empty", nil, 0},
+		{"single value", []float64{42}, 0},
+		{"known population", []float64{2, 4, 4, 4, 5, 5, 7, 9}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stddevFloat64(tt.vals); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("stddevFloat64(%v) = %v, want %v", tt.vals, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregateStats(t *testing.T) {
+	all := []jobResult{
+		{location: "ca", server: "http://ca.testmy.net", results: []result{
+			newResult("download", 1e6, 1*1e9),
+		}},
+		{location: "ca", server: "http://ca.testmy.net", results: []result{
+			newResult("download", 2e6, 1*1e9),
+		}},
+		{location: "ny", server: "http://ny.testmy.net", results: []result{
+			newResult("upload", 1e6, 1*1e9),
+		}},
+		// A jobResult with no results at all (both legs failed) must not
+		// contribute to any group.
+		{location: "ca", server: "http://ca.testmy.net", err: errors.New("boom")},
+		// A jobResult with a failed leg (err set) must still contribute
+		// the result of its other, successful leg.
+		{location: "ca", server: "http://ca.testmy.net", results: []result{
+			newResult("download", 3e6, 1*1e9),
+		}, err: errors.New("upload: boom")},
+	}
+
+	stats := aggregateStats(all)
+	if len(stats) != 2 {
+		t.Fatalf("got %d groups, want 2", len(stats))
+	}
+
+	for _, s := range stats {
+		if s.location == "ca" && s.label == "download" && s.n != 3 {
+			t.Errorf("ca/download: got n=%d, want 3", s.n)
+		}
+		if s.location == "ny" && s.label == "upload" && s.n != 1 {
+			t.Errorf("ny/upload: got n=%d, want 1", s.n)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// This file is part of testmynet_cli (http://github.com/marcopaganini/testmynet_cli)
+// See instructions in the README.md file that accompanies this program.
+// (C) by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	flag "github.com/spf13/pflag"
+)
+
+// envPrefix is prepended to the upper-cased, dash-to-underscore-converted
+// flag name to build its environment variable override, e.g. -location
+// becomes TESTMYNET_LOCATION.
+const envPrefix = "TESTMYNET_"
+
+// fileConfig mirrors the subset of cmdLineOpts that can be set from a
+// --config file. Fields left at their zero value are simply not applied,
+// so a config file only needs to list the keys it wants to override.
+type fileConfig struct {
+	Location    string `toml:"location"`
+	Server      string `toml:"server"`
+	Size        int    `toml:"size"`
+	Mode        string `toml:"mode"`
+	Format      string `toml:"format"`
+	Concurrency int    `toml:"concurrency"`
+	Repeat      int    `toml:"repeat"`
+	Verbose     int    `toml:"verbose"`
+	DryRun      bool   `toml:"dry-run"`
+}
+
+// loadConfigFile decodes a TOML config file and applies its values to fs,
+// skipping any flag name present in cliFlags. This must run after
+// fs.Parse(), so cliFlags can tell a flag genuinely given on the command
+// line apart from one this function (or applyEnvOverrides) is about to set
+// via fs.Set -- which pflag also marks Changed, and so can't be told apart
+// from a real command-line flag by itself.
+func loadConfigFile(path string, fs *flag.FlagSet, cliFlags map[string]bool) error {
+	var cfg fileConfig
+	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+		return err
+	}
+
+	set := func(name, value string) error {
+		if value == "" || cliFlags[name] {
+			return nil
+		}
+		return fs.Set(name, value)
+	}
+	setInt := func(name string, value int) error {
+		if value == 0 || cliFlags[name] {
+			return nil
+		}
+		return fs.Set(name, strconv.Itoa(value))
+	}
+
+	if err := set("location", cfg.Location); err != nil {
+		return err
+	}
+	if err := set("server", cfg.Server); err != nil {
+		return err
+	}
+	if err := setInt("size", cfg.Size); err != nil {
+		return err
+	}
+	if err := set("mode", cfg.Mode); err != nil {
+		return err
+	}
+	if err := set("format", cfg.Format); err != nil {
+		return err
+	}
+	if err := setInt("concurrency", cfg.Concurrency); err != nil {
+		return err
+	}
+	if err := setInt("repeat", cfg.Repeat); err != nil {
+		return err
+	}
+	if err := setInt("verbose", cfg.Verbose); err != nil {
+		return err
+	}
+	if cfg.DryRun && !cliFlags["dry-run"] {
+		if err := fs.Set("dry-run", "true"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyEnvOverrides sets every flag in fs from its TESTMYNET_* environment
+// variable, if set, skipping any flag name present in cliFlags. It must run
+// after fs.Parse(), for the same reason as loadConfigFile above.
+func applyEnvOverrides(fs *flag.FlagSet, cliFlags map[string]bool) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if cliFlags[f.Name] {
+			return
+		}
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if val, ok := os.LookupEnv(name); ok {
+			if err := fs.Set(f.Name, val); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: invalid value %q for %s: %v\n", val, name, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,94 @@
+// This file is part of testmynet_cli (http://github.com/marcopaganini/testmynet_cli)
+// See instructions in the README.md file that accompanies this program.
+// (C) by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	flag "github.com/spf13/pflag"
+)
+
+// newTestFlagSet registers a single "format" string flag, mirroring the
+// subset of parseFlags' registration relevant to these tests.
+func newTestFlagSet() (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	format := fs.String("format", formatText, "Output format")
+	return fs, format
+}
+
+func TestLoadConfigFileSkipsCLIFlags(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(path, []byte(`format = "csv"`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, format := newTestFlagSet()
+	if err := fs.Parse([]string{"--format=json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cliFlags := map[string]bool{"format": true}
+	if err := loadConfigFile(path, fs, cliFlags); err != nil {
+		t.Fatal(err)
+	}
+
+	if *format != "json" {
+		t.Errorf("format = %q, want %q (config file must not override a CLI flag)", *format, "json")
+	}
+}
+
+func TestLoadConfigFileAppliesWhenNotOnCLI(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.toml")
+	if err := os.WriteFile(path, []byte(`format = "csv"`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, format := newTestFlagSet()
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadConfigFile(path, fs, map[string]bool{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if *format != formatCSV {
+		t.Errorf("format = %q, want %q", *format, formatCSV)
+	}
+}
+
+func TestApplyEnvOverridesSkipsCLIFlags(t *testing.T) {
+	t.Setenv("TESTMYNET_FORMAT", "json")
+
+	fs, format := newTestFlagSet()
+	if err := fs.Parse([]string{"--format=csv"}); err != nil {
+		t.Fatal(err)
+	}
+
+	applyEnvOverrides(fs, map[string]bool{"format": true})
+
+	if *format != formatCSV {
+		t.Errorf("format = %q, want %q (env var must not override a CLI flag)", *format, formatCSV)
+	}
+}
+
+func TestApplyEnvOverridesAppliesWhenNotOnCLI(t *testing.T) {
+	t.Setenv("TESTMYNET_FORMAT", "json")
+
+	fs, format := newTestFlagSet()
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	applyEnvOverrides(fs, map[string]bool{})
+
+	if *format != formatJSON {
+		t.Errorf("format = %q, want %q", *format, formatJSON)
+	}
+}
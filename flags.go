@@ -5,29 +5,83 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"os"
 	"sort"
+	"strings"
+	"time"
+
+	flag "github.com/spf13/pflag"
 )
 
 const (
 	// Flag defaults.
-	defaultLocation = "ca"
-	defaultDataSize = 10240
-	tmnDomain       = "testmy.net"
-)
+	defaultLocation       = "ca"
+	defaultDataSize       = 10240
+	defaultConcurrency    = 1
+	defaultRepeat         = 1
+	defaultTimeout        = "30s"
+	defaultConnectTimeout = "10s"
+	defaultMaxConns       = 4
+	defaultUserAgent      = "testmynet-cli/1.0"
+	tmnDomain             = "testmy.net"
 
-type multiLevelInt int
+	// Valid values for the -mode flag.
+	modeDownload = "download"
+	modeUpload   = "upload"
+	modeBoth     = "both"
+)
 
 type cmdLineOpts struct {
-	csv      bool
-	datasize int
-	dryrun   bool
-	force    bool
-	location string
-	server   string
-	verbose  multiLevelInt
+	concurrency int
+	config      string
+	csv         bool
+	datasize    int
+	dryrun      bool
+	force       bool
+	format      string
+	location    string
+	mode        string
+	repeat      int
+	server      string
+	verbose     int
+
+	// locations and servers hold the parsed, comma-split form of
+	// "location" and "server", one server per location, filled in by
+	// parseFlags.
+	locations []string
+	servers   []string
+
+	// locationGiven records whether -location was actually set (on the
+	// command line, via environment variable, or in a config file), as
+	// opposed to left at its default. Used by -history to decide whether
+	// to scope to a single location or to the whole store.
+	locationGiven bool
+
+	// History-related flags. See history.go.
+	history      bool
+	from         string
+	until        string
+	prune        string
+	historyStats bool
+
+	// fromTime, untilTime and pruneDuration hold the parsed form of
+	// from/until/prune, filled in by parseFlags.
+	fromTime      time.Time
+	untilTime     time.Time
+	pruneDuration time.Duration
+
+	// HTTP client tuning. See httpclient.go.
+	timeout        string
+	connectTimeout string
+	maxConns       int
+	retries        int
+	userAgent      string
+
+	// timeoutDuration and connectTimeoutDuration hold the parsed form of
+	// timeout/connectTimeout, filled in by parseFlags.
+	timeoutDuration        time.Duration
+	connectTimeoutDuration time.Duration
 }
 
 var (
@@ -52,54 +106,158 @@ var (
 	}
 )
 
-// Definitions for the custom flag type multiLevelInt.
-
-// Return the string representation of the flag.
-// The String method's output will be used in diagnostics.
-func (m *multiLevelInt) String() string {
-	return fmt.Sprint(*m)
-}
-
-// Increase the value of multiLevelInt. This accepts multiple values
-// and sets the variable to the number of times those values appear in
-// the command-line. Useful for "verbose" and "Debug" levels.
-func (m *multiLevelInt) Set(_ string) error {
-	*m++
-	return nil
-}
-
-// Behave as a bool (i.e. no arguments).
-func (m *multiLevelInt) IsBoolFlag() bool {
-	return true
-}
-
 // parseFlags parses the command line and set the global opt variable. Return
 // error if the basic sanity checking of flags fails.
+//
+// Flags can also be set via environment variables (e.g. -location becomes
+// TESTMYNET_LOCATION) or via a config file loaded with --config. Precedence
+// is, from highest to lowest: command-line flags, environment variables,
+// config file, built-in default.
 func (x *cmdLineOpts) parseFlags() error {
-	flag.BoolVar(&x.csv, "csv", false, "Output results in csv")
-	flag.StringVar(&x.server, "server", "", "TestMyNet server (Overrides location)")
-	flag.StringVar(&x.location, "location", defaultLocation, "TestMyNet location")
-	flag.IntVar(&x.datasize, "size", defaultDataSize, "Test size in KBytes")
-	flag.BoolVar(&x.dryrun, "dry-run", false, "Dry-run mode")
+	flag.BoolVar(&x.csv, "csv", false, "Output results in csv (deprecated, use -format=csv)")
+	flag.StringVarP(&x.format, "format", "f", formatText, "Output format: text, csv, json or ndjson")
+	flag.StringVarP(&x.server, "server", "s", "", "TestMyNet server, comma-separated (overrides location)")
+	flag.StringVarP(&x.location, "location", "l", defaultLocation, "TestMyNet location, comma-separated for multiple locations")
+	flag.IntVarP(&x.datasize, "size", "n", defaultDataSize, "Test size in KBytes")
+	flag.StringVar(&x.mode, "mode", modeDownload, "Test mode: download, upload or both")
+	flag.IntVar(&x.concurrency, "concurrency", defaultConcurrency, "Number of concurrent test workers")
+	flag.IntVar(&x.repeat, "repeat", defaultRepeat, "Number of times to repeat each test")
+	flag.BoolVarP(&x.dryrun, "dry-run", "d", false, "Dry-run mode")
+	flag.BoolVar(&x.history, "history", false, "Show historical results instead of running a new test")
+	flag.StringVar(&x.from, "from", "", "History: start of interval (unix epoch or RFC3339). Default: 24h before -until")
+	flag.StringVar(&x.until, "until", "", "History: end of interval (unix epoch or RFC3339). Default: now")
+	flag.StringVar(&x.prune, "prune", "", "History: prune entries older than this duration (e.g. 720h) before querying")
+	flag.BoolVar(&x.historyStats, "stats", false, "History: show min/mean/p50/p95/max Mbps instead of raw entries")
 	flag.BoolVar(&x.force, "I-WANT-TO-GET-BANNED", false, "Allow program to hit testmy.net more often than it should.")
-	flag.Var(&x.verbose, "verbose", "Verbose mode (use multiple times to increase level)")
+	flag.CountVarP(&x.verbose, "verbose", "v", "Verbose mode (use multiple times to increase level)")
+	flag.StringVar(&x.config, "config", "", "Load flag values from a TOML config file")
+	flag.StringVar(&x.timeout, "timeout", defaultTimeout, "Total request timeout (e.g. 30s)")
+	flag.StringVar(&x.connectTimeout, "connect-timeout", defaultConnectTimeout, "TCP connect timeout (e.g. 10s)")
+	flag.IntVar(&x.maxConns, "max-conns", defaultMaxConns, "Maximum connections per host (MaxConnsPerHost/MaxIdleConnsPerHost)")
+	flag.IntVar(&x.retries, "retries", 0, "Number of retries on connection/5xx failures, with exponential backoff")
+	flag.StringVar(&x.userAgent, "user-agent", defaultUserAgent, "User-Agent header sent with every request")
+
 	flag.Parse()
 
+	// cliFlags records which flags were explicitly given on the real
+	// command line. It's captured right after Parse() and before config
+	// file / env var overrides are applied below, since fs.Set (used by
+	// both) also marks a flag Changed -- indistinguishable from a real
+	// command-line flag if we looked at flag.Lookup(...).Changed after
+	// the fact.
+	cliFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		cliFlags[f.Name] = true
+	})
+
+	// A config file (if any) provides defaults below env vars and above
+	// the hard-coded defaults above; env vars provide defaults below the
+	// command line and above the config file. Neither may override a flag
+	// already given on the command line.
+	if x.config != "" {
+		if err := loadConfigFile(x.config, flag.CommandLine, cliFlags); err != nil {
+			return fmt.Errorf("unable to load config file %q: %v", x.config, err)
+		}
+	}
+	applyEnvOverrides(flag.CommandLine, cliFlags)
+
+	x.locationGiven = flag.Lookup("location").Changed
+
 	// Print list of locations if location == help and exit.
 	if x.location == "help" {
 		fmt.Print(locationList(serverLocation))
 		os.Exit(2)
 	}
 
-	// Invalid location?
-	if _, ok := serverLocation[x.location]; !ok {
-		return fmt.Errorf("unable to find location %q. Use \"--location help\" to see all locations", x.location)
+	// The -csv flag is a deprecated alias for -format=csv. It only takes
+	// effect if -format wasn't explicitly given on the command line
+	// itself -- a config file or env var touching -format doesn't
+	// override an explicit -csv.
+	if x.csv && !cliFlags["format"] {
+		x.format = formatCSV
+	}
+
+	// Invalid format?
+	switch x.format {
+	case formatText, formatCSV, formatJSON, formatNDJSON:
+	default:
+		return fmt.Errorf("invalid format %q. Must be one of: %s, %s, %s, %s", x.format, formatText, formatCSV, formatJSON, formatNDJSON)
+	}
+
+	// Invalid mode?
+	switch x.mode {
+	case modeDownload, modeUpload, modeBoth:
+	default:
+		return fmt.Errorf("invalid mode %q. Must be one of: %s, %s, %s", x.mode, modeDownload, modeUpload, modeBoth)
+	}
+
+	if x.concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1, got %d", x.concurrency)
+	}
+	if x.repeat < 1 {
+		return fmt.Errorf("repeat must be at least 1, got %d", x.repeat)
+	}
+	if x.maxConns < 1 {
+		return fmt.Errorf("max-conns must be at least 1, got %d", x.maxConns)
+	}
+	if x.retries < 0 {
+		return fmt.Errorf("retries must be at least 0, got %d", x.retries)
+	}
+
+	var err error
+	if x.timeoutDuration, err = time.ParseDuration(x.timeout); err != nil {
+		return fmt.Errorf("invalid -timeout value %q: %v", x.timeout, err)
+	}
+	if x.connectTimeoutDuration, err = time.ParseDuration(x.connectTimeout); err != nil {
+		return fmt.Errorf("invalid -connect-timeout value %q: %v", x.connectTimeout, err)
+	}
+
+	// Split location into the list of locations to test, validating each
+	// one against the known server locations.
+	x.locations = strings.Split(x.location, ",")
+	for _, loc := range x.locations {
+		if _, ok := serverLocation[loc]; !ok {
+			return fmt.Errorf("unable to find location %q. Use \"--location help\" to see all locations", loc)
+		}
 	}
 
-	// Fill in server with server name based on location
-	// (if server was not directly specified)
+	// Fill in servers with server names based on locations (if server was
+	// not directly specified). When -server is used, it must have the
+	// same number of comma-separated entries as -location.
 	if x.server == "" {
-		x.server = fmt.Sprintf("http://%s.%s", x.location, tmnDomain)
+		for _, loc := range x.locations {
+			x.servers = append(x.servers, fmt.Sprintf("http://%s.%s", loc, tmnDomain))
+		}
+	} else {
+		x.servers = strings.Split(x.server, ",")
+		if len(x.servers) != len(x.locations) {
+			return fmt.Errorf("got %d servers but %d locations; -server and -location must have the same number of comma-separated entries", len(x.servers), len(x.locations))
+		}
+	}
+
+	// Parse the history-related flags, defaulting to the last 24h.
+	x.untilTime = time.Now()
+	if x.until != "" {
+		t, err := parseTimeArg(x.until)
+		if err != nil {
+			return fmt.Errorf("invalid -until value %q: %v", x.until, err)
+		}
+		x.untilTime = t
+	}
+	x.fromTime = x.untilTime.Add(-24 * time.Hour)
+	if x.from != "" {
+		t, err := parseTimeArg(x.from)
+		if err != nil {
+			return fmt.Errorf("invalid -from value %q: %v", x.from, err)
+		}
+		x.fromTime = t
+	}
+	if x.prune != "" {
+		d, err := time.ParseDuration(x.prune)
+		if err != nil {
+			return fmt.Errorf("invalid -prune value %q: %v", x.prune, err)
+		}
+		x.pruneDuration = d
 	}
 
 	return nil
@@ -0,0 +1,287 @@
+// This file is part of testmynet_cli (http://github.com/marcopaganini/testmynet_cli)
+// See instructions in the README.md file that accompanies this program.
+// (C) by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const historyDirName = ".testmynet-cli/history"
+
+// historyRecord is a single measurement appended to the history store, one
+// per successful download or upload test. Mode ("download" or "upload")
+// keeps the two series separate within a location's history file.
+type historyRecord struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Location   string    `json:"location"`
+	Server     string    `json:"server"`
+	Mode       string    `json:"mode"`
+	Bytes      int64     `json:"bytes"`
+	DurationNS int64     `json:"duration_ns"`
+	Mbps       float64   `json:"mbps"`
+}
+
+// historyStats holds min/mean/p50/p95/max Mbps for a location/mode pair
+// over a queried interval.
+type historyStats struct {
+	location string
+	mode     string
+	n        int
+	min      float64
+	mean     float64
+	p50      float64
+	p95      float64
+	max      float64
+}
+
+// historyDir returns the directory holding the history store, creating it
+// if necessary.
+func historyDir() (string, error) {
+	home, err := homeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, historyDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// historyFile returns the append-only, one-record-per-line file backing a
+// single location.
+func historyFile(dir, location string) string {
+	return filepath.Join(dir, location+".ndjson")
+}
+
+// appendHistory records a successful measurement to the per-location
+// history file.
+func appendHistory(location, server, mode string, bytes int64, duration time.Duration, mbps float64) error {
+	dir, err := historyDir()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(historyFile(dir, location), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rec := historyRecord{
+		Timestamp:  time.Now(),
+		Location:   location,
+		Server:     server,
+		Mode:       mode,
+		Bytes:      bytes,
+		DurationNS: int64(duration),
+		Mbps:       mbps,
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(buf, '\n'))
+	return err
+}
+
+// readAllHistory reads every record in a location's history file,
+// regardless of timestamp.
+func readAllHistory(dir, location string) ([]historyRecord, error) {
+	buf, err := ioutil.ReadFile(historyFile(dir, location))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var recs []historyRecord
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line == "" {
+			continue
+		}
+		var rec historyRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// readHistory reads a location's history file and returns only the
+// records whose timestamp falls within [from, until].
+func readHistory(dir, location string, from, until time.Time) ([]historyRecord, error) {
+	all, err := readAllHistory(dir, location)
+	if err != nil {
+		return nil, err
+	}
+	var recs []historyRecord
+	for _, rec := range all {
+		if rec.Timestamp.Before(from) || rec.Timestamp.After(until) {
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// pruneHistoryFile drops every record in a location's history file older
+// than "retention" and rewrites the file in place.
+func pruneHistoryFile(dir, location string, retention time.Duration) error {
+	all, err := readAllHistory(dir, location)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-retention)
+	var buf []byte
+	for _, rec := range all {
+		if rec.Timestamp.Before(cutoff) {
+			continue
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+	return ioutil.WriteFile(historyFile(dir, location), buf, 0644)
+}
+
+// parseTimeArg parses a time given either as Unix epoch seconds or as
+// RFC3339.
+func parseTimeArg(s string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// computeHistoryStats computes min/mean/p50/p95/max Mbps for a set of
+// history records belonging to a single location, grouped by mode
+// (download/upload) the same way aggregateStats groups live runs, so a
+// location's download and upload series are never blended together.
+func computeHistoryStats(location string, recs []historyRecord) []historyStats {
+	var modes []string
+	groups := map[string][]float64{}
+	for _, rec := range recs {
+		if _, ok := groups[rec.Mode]; !ok {
+			modes = append(modes, rec.Mode)
+		}
+		groups[rec.Mode] = append(groups[rec.Mode], rec.Mbps)
+	}
+
+	stats := make([]historyStats, 0, len(modes))
+	for _, mode := range modes {
+		vals := groups[mode]
+		stats = append(stats, historyStats{
+			location: location,
+			mode:     mode,
+			n:        len(vals),
+			min:      minFloat64(vals),
+			mean:     meanFloat64(vals),
+			p50:      percentileFloat64(vals, 50),
+			p95:      percentileFloat64(vals, 95),
+			max:      maxFloat64(vals),
+		})
+	}
+	return stats
+}
+
+// percentileFloat64 returns the nearest-rank p-th percentile (0-100) of
+// vals.
+func percentileFloat64(vals []float64, p float64) float64 {
+	sorted := append([]float64{}, vals...)
+	sort.Float64s(sorted)
+	ix := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if ix < 0 {
+		ix = 0
+	}
+	if ix > len(sorted)-1 {
+		ix = len(sorted) - 1
+	}
+	return sorted[ix]
+}
+
+// historyLocations returns every location with an existing history file in
+// dir, sorted alphabetically.
+func historyLocations(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var locs []string
+	for _, e := range entries {
+		if name := e.Name(); strings.HasSuffix(name, ".ndjson") {
+			locs = append(locs, strings.TrimSuffix(name, ".ndjson"))
+		}
+	}
+	sort.Strings(locs)
+	return locs, nil
+}
+
+// runHistoryCommand serves the -history query: it loads the relevant
+// history file(s), applies -from/-until filtering (and -prune, if
+// requested), and prints either raw entries or summary stats depending on
+// -stats.
+//
+// When -location wasn't given, it operates on every location with an
+// existing history file, rather than silently defaulting to -location's
+// own default ("ca").
+func runHistoryCommand(opt *cmdLineOpts, out OutputWriter) error {
+	dir, err := historyDir()
+	if err != nil {
+		return err
+	}
+
+	locs := opt.locations
+	if !opt.locationGiven {
+		locs, err = historyLocations(dir)
+		if err != nil {
+			return fmt.Errorf("unable to list history locations: %v", err)
+		}
+	}
+
+	for _, loc := range locs {
+		if opt.pruneDuration > 0 {
+			if err := pruneHistoryFile(dir, loc, opt.pruneDuration); err != nil {
+				return fmt.Errorf("unable to prune history for %q: %v", loc, err)
+			}
+		}
+
+		recs, err := readHistory(dir, loc, opt.fromTime, opt.untilTime)
+		if err != nil {
+			return fmt.Errorf("unable to read history for %q: %v", loc, err)
+		}
+
+		if opt.historyStats {
+			for _, s := range computeHistoryStats(loc, recs) {
+				if err := out.WriteHistoryStats(s); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		for _, rec := range recs {
+			if err := out.WriteHistory(rec); err != nil {
+				return err
+			}
+		}
+	}
+
+	return out.Flush()
+}
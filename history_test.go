@@ -0,0 +1,88 @@
+// This file is part of testmynet_cli (http://github.com/marcopaganini/testmynet_cli)
+// See instructions in the README.md file that accompanies this program.
+// (C) by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPercentileFloat64(t *testing.T) {
+	tests := []struct {
+		name string
+		vals []float64
+		p    float64
+		want float64
+	}{
+		{"p50 odd count", []float64{10, 20, 30}, 50, 20},
+		{"p95 small sample", []float64{10, 20, 30}, 95, 30},
+		{"p100 is max", []float64{10, 20, 30}, 100, 30},
+		{"p0 is min", []float64{10, 20, 30}, 0, 10},
+		{"single value", []float64{42}, 95, 42},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := percentileFloat64(tt.vals, tt.p); got != tt.want {
+				t.Errorf("percentileFloat64(%v, %v) = %v, want %v", tt.vals, tt.p, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComputeHistoryStats(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	recs := []historyRecord{
+		{Timestamp: now, Location: "ca", Mode: "download", Mbps: 10},
+		{Timestamp: now, Location: "ca", Mode: "download", Mbps: 20},
+		{Timestamp: now, Location: "ca", Mode: "download", Mbps: 30},
+	}
+
+	stats := computeHistoryStats("ca", recs)
+	if len(stats) != 1 {
+		t.Fatalf("got %d groups, want 1", len(stats))
+	}
+	s := stats[0]
+	if s.n != 3 {
+		t.Errorf("n = %d, want 3", s.n)
+	}
+	if s.min != 10 {
+		t.Errorf("min = %v, want 10", s.min)
+	}
+	if s.max != 30 {
+		t.Errorf("max = %v, want 30", s.max)
+	}
+	if s.p95 != 30 {
+		t.Errorf("p95 = %v, want 30 (nearest-rank on 3 samples)", s.p95)
+	}
+}
+
+func TestComputeHistoryStatsSplitsByMode(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	recs := []historyRecord{
+		{Timestamp: now, Location: "ca", Mode: "download", Mbps: 200},
+		{Timestamp: now, Location: "ca", Mode: "download", Mbps: 220},
+		{Timestamp: now, Location: "ca", Mode: "upload", Mbps: 20},
+	}
+
+	stats := computeHistoryStats("ca", recs)
+	if len(stats) != 2 {
+		t.Fatalf("got %d groups, want 2 (download and upload must not blend)", len(stats))
+	}
+	for _, s := range stats {
+		switch s.mode {
+		case "download":
+			if s.n != 2 || s.mean != 210 {
+				t.Errorf("download: got n=%d mean=%v, want n=2 mean=210", s.n, s.mean)
+			}
+		case "upload":
+			if s.n != 1 || s.mean != 20 {
+				t.Errorf("upload: got n=%d mean=%v, want n=1 mean=20", s.n, s.mean)
+			}
+		default:
+			t.Errorf("unexpected mode %q", s.mode)
+		}
+	}
+}
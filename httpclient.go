@@ -0,0 +1,90 @@
+// This file is part of testmynet_cli (http://github.com/marcopaganini/testmynet_cli)
+// See instructions in the README.md file that accompanies this program.
+// (C) by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"crypto/tls"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+var (
+	// httpClient is the shared HTTP client used by download and upload,
+	// built once in main() from the -timeout, -connect-timeout and
+	// -max-conns flags.
+	httpClient *http.Client
+
+	// userAgent is sent with every request, controlled by -user-agent.
+	userAgent string
+)
+
+// newHTTPClient builds the shared *http.Client used for every download and
+// upload request, applying the connection and timeout flags.
+func newHTTPClient(opt *cmdLineOpts) *http.Client {
+	dialer := &net.Dialer{Timeout: opt.connectTimeoutDuration}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		MaxConnsPerHost:     opt.maxConns,
+		MaxIdleConnsPerHost: opt.maxConns,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   opt.timeoutDuration,
+	}
+}
+
+// traceRequest attaches an httptrace.ClientTrace to req that logs the
+// negotiated remote address in verbose mode, so users can tell whether
+// they hit IPv4 or IPv6, and whether the connection was reused.
+func traceRequest(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			log.Verbosef(1, "Connected to %s (reused=%v)\n", info.Conn.RemoteAddr(), info.Reused)
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// logResponseInfo logs the negotiated HTTP protocol and, for HTTPS, the
+// TLS version used for res.
+func logResponseInfo(res *http.Response) {
+	log.Verbosef(1, "Protocol: %s\n", res.Proto)
+	if res.TLS != nil {
+		log.Verbosef(1, "TLS version: %s\n", tls.VersionName(res.TLS.Version))
+	}
+}
+
+// retryBackoff returns the exponential backoff delay before retry attempt
+// "attempt" (1-based): 1s, 2s, 4s, 8s, ...
+func retryBackoff(attempt int) time.Duration {
+	return time.Duration(math.Pow(2, float64(attempt-1))) * time.Second
+}
+
+// withRetry calls fn, retrying up to "retries" additional times with
+// exponential backoff between attempts whenever fn returns an error.
+// download and upload treat both connection failures and 5xx responses as
+// errors, so any error here is eligible for a retry.
+func withRetry(retries int, fn func() (int64, time.Duration, error)) (int64, time.Duration, error) {
+	var (
+		bytes    int64
+		duration time.Duration
+		err      error
+	)
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			backoff := retryBackoff(attempt)
+			log.Verbosef(1, "Retrying (attempt %d/%d) after %s: %v\n", attempt, retries, backoff, err)
+			time.Sleep(backoff)
+		}
+		bytes, duration, err = fn()
+		if err == nil {
+			return bytes, duration, nil
+		}
+	}
+	return 0, 0, err
+}
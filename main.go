@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/user"
@@ -22,6 +23,11 @@ import (
 const (
 	stateFile          = ".testmynet-cli.state"
 	minDurationMinutes = 15
+
+	// PRNG seed used to generate the synthetic upload payload. Fixed so
+	// runs are reproducible and we don't need to buffer the payload in
+	// memory.
+	uploadSeed = 42
 )
 
 var (
@@ -35,20 +41,32 @@ func download(server string, datasize int, dryrun bool) (int64, time.Duration, e
 	uri := fmt.Sprintf("%s/dl-%d", server, datasize)
 	log.Verbosef(1, "Starting download from %q\n", uri)
 
-	res, err := http.Get(uri)
-	if err != nil {
-		return 0, 0, err
-	}
-	defer res.Body.Close()
-
 	// Default values, used if we're doing a dry-run.
 	written := int64(1e6)
 	duration := time.Duration(8 * time.Second)
 
 	if !dryrun {
+		req, err := http.NewRequest(http.MethodGet, uri, nil)
+		if err != nil {
+			return 0, 0, err
+		}
+		req.Header.Set("User-Agent", userAgent)
+		req = traceRequest(req)
+
 		// Timed download
 		tstart := time.Now()
 
+		res, err := httpClient.Do(req)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer res.Body.Close()
+		logResponseInfo(res)
+
+		if res.StatusCode >= 500 {
+			return 0, 0, fmt.Errorf("server returned %s", res.Status)
+		}
+
 		written, err = io.Copy(ioutil.Discard, res.Body)
 		if err != nil {
 			return 0, 0, err
@@ -60,6 +78,71 @@ func download(server string, datasize int, dryrun bool) (int64, time.Duration, e
 	return written, duration, nil
 }
 
+// randReader is an io.Reader that produces an endless stream of
+// pseudo-random bytes from a seeded PRNG. It's used to generate the upload
+// payload without having to allocate and hold the whole thing in memory.
+type randReader struct {
+	rnd *rand.Rand
+}
+
+func newRandReader(seed int64) *randReader {
+	return &randReader{rnd: rand.New(rand.NewSource(seed))}
+}
+
+func (r *randReader) Read(p []byte) (int, error) {
+	return r.rnd.Read(p)
+}
+
+// upload sends "datasize" KBytes of synthetic data to the test server and
+// returns the number of bytes effectively sent and the time it took to send
+// them.
+func upload(server string, datasize int, dryrun bool) (int64, time.Duration, error) {
+	uri := fmt.Sprintf("%s/ul-%d", server, datasize)
+	log.Verbosef(1, "Starting upload to %q\n", uri)
+
+	// Default values, used if we're doing a dry-run.
+	written := int64(1e6)
+	duration := time.Duration(8 * time.Second)
+
+	if !dryrun {
+		size := int64(datasize) * 1024
+		body := io.LimitReader(newRandReader(uploadSeed), size)
+
+		req, err := http.NewRequest(http.MethodPost, uri, body)
+		if err != nil {
+			return 0, 0, err
+		}
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = size
+		req = traceRequest(req)
+
+		// Timed upload
+		tstart := time.Now()
+
+		res, err := httpClient.Do(req)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer res.Body.Close()
+		logResponseInfo(res)
+
+		if res.StatusCode >= 500 {
+			return 0, 0, fmt.Errorf("server returned %s", res.Status)
+		}
+
+		if _, err := io.Copy(ioutil.Discard, res.Body); err != nil {
+			return 0, 0, err
+		}
+
+		duration = time.Since(tstart)
+		written = size
+	}
+
+	log.Verbosef(1, "%d bytes uploaded in %s\n", written, duration)
+	return written, duration, nil
+}
+
 // homeDir returns the user's home directory or an error if the variable HOME
 // is not set, or os.user fails, or the directory cannot be found.
 func homeDir() (string, error) {
@@ -125,6 +208,22 @@ func overloadProtection(stateFile string, minDuration time.Duration) error {
 	return nil
 }
 
+// result holds the outcome of a single download or upload test, together
+// with the computed bandwidth in Mbps.
+type result struct {
+	label    string
+	bytes    int64
+	duration time.Duration
+	bw       float64
+}
+
+// newResult builds a result from the raw bytes/duration measured by
+// download or upload, computing the resulting bandwidth in Mbps.
+func newResult(label string, bytes int64, duration time.Duration) result {
+	bw := (float64(bytes) * 8 / duration.Seconds()) / 1e6
+	return result{label: label, bytes: bytes, duration: duration, bw: bw}
+}
+
 func main() {
 	log = logger.New("")
 	opt := &cmdLineOpts{}
@@ -135,29 +234,71 @@ func main() {
 	}
 
 	// Set verbose level
-	verbose := int(opt.verbose)
-	if verbose > 0 {
-		log.SetVerboseLevel(verbose)
+	if opt.verbose > 0 {
+		log.SetVerboseLevel(opt.verbose)
 	}
 
-	bytes, duration, err := download(opt.server, opt.datasize, opt.dryrun)
+	out, err := NewOutputWriter(opt.format)
 	if err != nil {
-		log.Fatalf("Error downloading data from %s: %v\n", opt.server, err)
+		log.Fatalf("Error: %s\n", err)
 	}
 
-	// Don't overload testmy.net (unless force is set).
+	httpClient = newHTTPClient(opt)
+	userAgent = opt.userAgent
+
+	// -history queries the local results store instead of running a new
+	// test.
+	if opt.history {
+		if err := runHistoryCommand(opt, out); err != nil {
+			log.Fatalf("Error: %s\n", err)
+		}
+		return
+	}
+
+	// Run the test(s) requested by -mode against every location/server
+	// pair, -repeat times each, using -concurrency worker goroutines.
+	all := runBenchmark(opt)
+
+	// Don't overload testmy.net (unless force is set). The state file
+	// records the last full run regardless of mode, location count, or
+	// repeat count.
 	if !opt.force {
 		if err := overloadProtection(stateFile, time.Duration(minDurationMinutes*time.Minute)); err != nil {
 			log.Fatalf("Error: %s\n", err)
 		}
 	}
 
-	// Calculate bandwidth and print.
-	bw := (float64(bytes) * 8 / duration.Seconds()) / 1e6
-	if opt.csv {
-		fmt.Printf("%s,%d,%.2f,%.3f\n", opt.server, bytes, duration.Seconds(), bw)
-	} else {
-		fmt.Printf("Downloaded %d bytes from %s in %s. Bandwidth = %.3fMbps\n",
-			bytes, opt.server, duration, bw)
+	// Emit one record per individual test run, and append it to the
+	// local history store. A jobResult can carry both an error and
+	// results at the same time (e.g. -mode both with a failing upload
+	// but a successful download), so the two are handled independently.
+	for _, jr := range all {
+		if jr.err != nil {
+			fmt.Fprintf(os.Stderr, "Error testing %s (%s): %v\n", jr.server, jr.location, jr.err)
+		}
+		for _, r := range jr.results {
+			if err := out.WriteResult(jr, r); err != nil {
+				log.Fatalf("Error writing result: %s\n", err)
+			}
+			if !opt.dryrun {
+				if err := appendHistory(jr.location, jr.server, r.label, r.bytes, r.duration, r.bw); err != nil {
+					fmt.Fprintf(os.Stderr, "Warning: unable to save history for %s: %v\n", jr.location, err)
+				}
+			}
+		}
+	}
+
+	// Emit summary statistics per location/mode, when there's more than
+	// one run to summarize.
+	if len(opt.locations) > 1 || opt.repeat > 1 {
+		for _, s := range aggregateStats(all) {
+			if err := out.WriteStats(s); err != nil {
+				log.Fatalf("Error writing stats: %s\n", err)
+			}
+		}
+	}
+
+	if err := out.Flush(); err != nil {
+		log.Fatalf("Error flushing output: %s\n", err)
 	}
 }
@@ -0,0 +1,217 @@
+// This file is part of testmynet_cli (http://github.com/marcopaganini/testmynet_cli)
+// See instructions in the README.md file that accompanies this program.
+// (C) by Marco Paganini <paganini AT paganini DOT net>
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// Valid values for the -format flag.
+	formatText   = "text"
+	formatCSV    = "csv"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+)
+
+// outputRecord is the structured representation of a single test result or
+// a stats summary, used by the JSON and NDJSON writers.
+type outputRecord struct {
+	Type         string  `json:"type"`
+	Server       string  `json:"server,omitempty"`
+	Location     string  `json:"location"`
+	LocationDesc string  `json:"location_description,omitempty"`
+	Mode         string  `json:"mode,omitempty"`
+	Timestamp    string  `json:"timestamp,omitempty"`
+	Bytes        int64   `json:"bytes,omitempty"`
+	DurationMS   int64   `json:"duration_ms,omitempty"`
+	Mbps         float64 `json:"mbps,omitempty"`
+	Samples      int     `json:"samples,omitempty"`
+	Min          float64 `json:"min_mbps,omitempty"`
+	Median       float64 `json:"median_mbps,omitempty"`
+	Mean         float64 `json:"mean_mbps,omitempty"`
+	Max          float64 `json:"max_mbps,omitempty"`
+	StdDev       float64 `json:"stddev_mbps,omitempty"`
+	P50          float64 `json:"p50_mbps,omitempty"`
+	P95          float64 `json:"p95_mbps,omitempty"`
+}
+
+// OutputWriter formats and emits individual test results, aggregated
+// stats, and history entries. Each -format value (text, csv, json,
+// ndjson) has its own implementation.
+type OutputWriter interface {
+	WriteResult(jr jobResult, r result) error
+	WriteStats(s locStats) error
+	WriteHistory(rec historyRecord) error
+	WriteHistoryStats(s historyStats) error
+	Flush() error
+}
+
+// NewOutputWriter returns the OutputWriter matching the given -format
+// value.
+func NewOutputWriter(format string) (OutputWriter, error) {
+	switch format {
+	case formatText:
+		return &textWriter{}, nil
+	case formatCSV:
+		return &csvWriter{}, nil
+	case formatJSON:
+		return &jsonWriter{}, nil
+	case formatNDJSON:
+		return &jsonWriter{ndjson: true}, nil
+	}
+	return nil, fmt.Errorf("invalid format %q. Must be one of: %s, %s, %s, %s", format, formatText, formatCSV, formatJSON, formatNDJSON)
+}
+
+// textWriter prints human-readable lines to stdout.
+type textWriter struct{}
+
+func (w *textWriter) WriteResult(jr jobResult, r result) error {
+	fmt.Printf("%s (%s) %s: %d bytes transferred in %s. Bandwidth = %.3fMbps\n",
+		jr.location, jr.server, r.label, r.bytes, r.duration, r.bw)
+	return nil
+}
+
+func (w *textWriter) WriteStats(s locStats) error {
+	fmt.Printf("%s %s stats (n=%d): min=%.3f median=%.3f mean=%.3f max=%.3f stddev=%.3f Mbps\n",
+		s.location, s.label, s.n, s.min, s.median, s.mean, s.max, s.stddev)
+	return nil
+}
+
+func (w *textWriter) WriteHistory(rec historyRecord) error {
+	fmt.Printf("%s %s %s %s: %d bytes in %s. Bandwidth = %.3fMbps\n",
+		rec.Timestamp.Format(time.RFC3339), rec.Location, rec.Server, rec.Mode, rec.Bytes,
+		time.Duration(rec.DurationNS), rec.Mbps)
+	return nil
+}
+
+func (w *textWriter) WriteHistoryStats(s historyStats) error {
+	fmt.Printf("%s %s stats (n=%d): min=%.3f mean=%.3f p50=%.3f p95=%.3f max=%.3f Mbps\n",
+		s.location, s.mode, s.n, s.min, s.mean, s.p50, s.p95, s.max)
+	return nil
+}
+
+func (w *textWriter) Flush() error { return nil }
+
+// csvWriter prints comma-separated lines to stdout.
+type csvWriter struct{}
+
+func (w *csvWriter) WriteResult(jr jobResult, r result) error {
+	fmt.Printf("%s,%s,%s,%d,%.2f,%.3f\n", jr.location, jr.server, r.label, r.bytes, r.duration.Seconds(), r.bw)
+	return nil
+}
+
+func (w *csvWriter) WriteStats(s locStats) error {
+	fmt.Printf("stats,%s,%s,%d,%.3f,%.3f,%.3f,%.3f,%.3f\n",
+		s.location, s.label, s.n, s.min, s.median, s.mean, s.max, s.stddev)
+	return nil
+}
+
+func (w *csvWriter) WriteHistory(rec historyRecord) error {
+	fmt.Printf("%s,%s,%s,%s,%d,%.2f,%.3f\n",
+		rec.Timestamp.Format(time.RFC3339), rec.Location, rec.Server, rec.Mode, rec.Bytes,
+		time.Duration(rec.DurationNS).Seconds(), rec.Mbps)
+	return nil
+}
+
+func (w *csvWriter) WriteHistoryStats(s historyStats) error {
+	fmt.Printf("history-stats,%s,%s,%d,%.3f,%.3f,%.3f,%.3f,%.3f\n",
+		s.location, s.mode, s.n, s.min, s.mean, s.p50, s.p95, s.max)
+	return nil
+}
+
+func (w *csvWriter) Flush() error { return nil }
+
+// jsonWriter emits one JSON object per line when ndjson is true, or
+// collects every record into a single JSON array printed on Flush.
+type jsonWriter struct {
+	ndjson  bool
+	records []outputRecord
+}
+
+func (w *jsonWriter) emit(rec outputRecord) error {
+	if w.ndjson {
+		buf, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+		return nil
+	}
+	w.records = append(w.records, rec)
+	return nil
+}
+
+func (w *jsonWriter) WriteResult(jr jobResult, r result) error {
+	return w.emit(outputRecord{
+		Type:         "result",
+		Server:       jr.server,
+		Location:     jr.location,
+		LocationDesc: serverLocation[jr.location],
+		Mode:         r.label,
+		Timestamp:    time.Now().Format(time.RFC3339),
+		Bytes:        r.bytes,
+		DurationMS:   r.duration.Milliseconds(),
+		Mbps:         r.bw,
+	})
+}
+
+func (w *jsonWriter) WriteStats(s locStats) error {
+	return w.emit(outputRecord{
+		Type:         "stats",
+		Location:     s.location,
+		LocationDesc: serverLocation[s.location],
+		Mode:         s.label,
+		Samples:      s.n,
+		Min:          s.min,
+		Median:       s.median,
+		Mean:         s.mean,
+		Max:          s.max,
+		StdDev:       s.stddev,
+	})
+}
+
+func (w *jsonWriter) WriteHistory(rec historyRecord) error {
+	return w.emit(outputRecord{
+		Type:         "history",
+		Server:       rec.Server,
+		Location:     rec.Location,
+		LocationDesc: serverLocation[rec.Location],
+		Mode:         rec.Mode,
+		Timestamp:    rec.Timestamp.Format(time.RFC3339),
+		Bytes:        rec.Bytes,
+		DurationMS:   rec.DurationNS / 1e6,
+		Mbps:         rec.Mbps,
+	})
+}
+
+func (w *jsonWriter) WriteHistoryStats(s historyStats) error {
+	return w.emit(outputRecord{
+		Type:         "history_stats",
+		Location:     s.location,
+		LocationDesc: serverLocation[s.location],
+		Mode:         s.mode,
+		Samples:      s.n,
+		Min:          s.min,
+		Mean:         s.mean,
+		P50:          s.p50,
+		P95:          s.p95,
+		Max:          s.max,
+	})
+}
+
+func (w *jsonWriter) Flush() error {
+	if w.ndjson {
+		return nil
+	}
+	buf, err := json.MarshalIndent(w.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(buf))
+	return nil
+}